@@ -2,32 +2,42 @@ package p2p
 
 import (
 	"bufio"
+	"bytes"
+	stdbinary "encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net"
 	"runtime/debug"
 	"sync/atomic"
 	"time"
 
 	flow "code.google.com/p/mxk/go1/flowcontrol"
+	"code.google.com/p/snappy-go/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/op/go-logging"
 	. "github.com/tendermint/tendermint/binary"
 	. "github.com/tendermint/tendermint/common"
 )
 
 const (
-	numBatchPackets           = 10
-	minReadBufferSize         = 1024
-	minWriteBufferSize        = 1024
-	flushThrottleMS           = 50
-	idleTimeoutMinutes        = 5
-	updateStatsSeconds        = 2
-	pingTimeoutMinutes        = 2
-	defaultSendRate           = 51200 // 5Kb/s
-	defaultRecvRate           = 51200 // 5Kb/s
-	defaultSendQueueCapacity  = 1
-	defaultRecvBufferCapacity = 4096
+	numBatchPackets            = 10
+	minReadBufferSize          = 1024
+	minWriteBufferSize         = 1024
+	flushThrottleMS            = 50
+	idleTimeoutMinutes         = 5
+	pingTimeoutMinutes         = 2
+	defaultSendRate            = 51200 // 5Kb/s
+	defaultRecvRate            = 51200 // 5Kb/s
+	defaultSendQueueCapacity   = 1
+	defaultRecvBufferCapacity  = 4096
+	defaultRecvMessageCapacity = 22020096 // 21MB, should be greater than recvBufferCapacity
+	defaultSendTimeout         = 10 * time.Second
+
+	// rateBlockedRetryInterval is how long sendRoutine waits before
+	// re-checking a channel that was over its own SendRate budget, see
+	// sendPacket.
+	rateBlockedRetryInterval = 20 * time.Millisecond
 )
 
 type receiveCbFunc func(chId byte, msgBytes []byte)
@@ -39,51 +49,59 @@ Binary messages are sent with ".Send(channelId, msg)".
 Inbound message bytes are handled with an onReceive callback function.
 */
 type MConnection struct {
-	conn         net.Conn
-	bufReader    *bufio.Reader
-	bufWriter    *bufio.Writer
-	sendMonitor  *flow.Monitor
-	recvMonitor  *flow.Monitor
-	sendRate     int64
-	recvRate     int64
-	flushTimer   *ThrottleTimer // flush writes as necessary but throttled.
-	send         chan struct{}
-	quit         chan struct{}
-	pingTimer    *RepeatTimer // send pings periodically
-	pong         chan struct{}
-	chStatsTimer *RepeatTimer // update channel stats periodically
-	channels     []*Channel
-	channelsIdx  map[byte]*Channel
-	onReceive    receiveCbFunc
-	onError      errorCbFunc
-	started      uint32
-	stopped      uint32
-	errored      uint32
+	conn        net.Conn
+	bufReader   *bufio.Reader
+	bufWriter   *bufio.Writer
+	sendMonitor *flow.Monitor
+	recvMonitor *flow.Monitor
+	sendRate    int64
+	recvRate    int64
+	flushTimer  *ThrottleTimer // flush writes as necessary but throttled.
+	send        chan struct{}
+	quit        chan struct{}
+	pingTimer   *RepeatTimer // send pings periodically
+	pong        chan struct{}
+	channels    []*Channel
+	channelsIdx map[byte]*Channel
+	onReceive   receiveCbFunc
+	onError     errorCbFunc
+	started     uint32
+	stopped     uint32
+	errored     uint32
+
+	// maxPacketMsgPayloadSize is negotiated with the peer during the
+	// connection handshake; it starts out as our own local preference and
+	// is clamped down to whatever the peer advertises, see exchangeHandshake.
+	maxPacketMsgPayloadSize int
 
 	LocalAddress  *NetAddress
 	RemoteAddress *NetAddress
 }
 
+// NewMConnection wraps conn, multiplexing chDescs over it. conn is expected
+// to already be the connection a Transport handed back - plain TCP, or a
+// *SecretConnection if the peer should be authenticated and encrypted -
+// MConnection itself doesn't know or care which.
 func NewMConnection(conn net.Conn, chDescs []*ChannelDescriptor, onReceive receiveCbFunc, onError errorCbFunc) *MConnection {
 
 	mconn := &MConnection{
-		conn:          conn,
-		bufReader:     bufio.NewReaderSize(conn, minReadBufferSize),
-		bufWriter:     bufio.NewWriterSize(conn, minWriteBufferSize),
-		sendMonitor:   flow.New(0, 0),
-		recvMonitor:   flow.New(0, 0),
-		sendRate:      defaultSendRate,
-		recvRate:      defaultRecvRate,
-		flushTimer:    NewThrottleTimer(flushThrottleMS * time.Millisecond),
-		send:          make(chan struct{}, 1),
-		quit:          make(chan struct{}),
-		pingTimer:     NewRepeatTimer(pingTimeoutMinutes * time.Minute),
-		pong:          make(chan struct{}),
-		chStatsTimer:  NewRepeatTimer(updateStatsSeconds * time.Second),
-		onReceive:     onReceive,
-		onError:       onError,
-		LocalAddress:  NewNetAddress(conn.LocalAddr()),
-		RemoteAddress: NewNetAddress(conn.RemoteAddr()),
+		conn:                    conn,
+		bufReader:               bufio.NewReaderSize(conn, minReadBufferSize),
+		bufWriter:               bufio.NewWriterSize(conn, minWriteBufferSize),
+		sendMonitor:             flow.New(0, 0),
+		recvMonitor:             flow.New(0, 0),
+		sendRate:                defaultSendRate,
+		recvRate:                defaultRecvRate,
+		flushTimer:              NewThrottleTimer(flushThrottleMS * time.Millisecond),
+		send:                    make(chan struct{}, 1),
+		quit:                    make(chan struct{}),
+		pingTimer:               NewRepeatTimer(pingTimeoutMinutes * time.Minute),
+		pong:                    make(chan struct{}),
+		onReceive:               onReceive,
+		onError:                 onError,
+		maxPacketMsgPayloadSize: defaultMaxPacketMsgPayloadSize,
+		LocalAddress:            NewNetAddress(conn.LocalAddr()),
+		RemoteAddress:           NewNetAddress(conn.RemoteAddr()),
 	}
 
 	// Create channels
@@ -91,6 +109,7 @@ func NewMConnection(conn net.Conn, chDescs []*ChannelDescriptor, onReceive recei
 	var channels = []*Channel{}
 
 	for _, desc := range chDescs {
+		desc.FillDefaults()
 		channel := newChannel(mconn, desc)
 		channelsIdx[channel.id] = channel
 		channels = append(channels, channel)
@@ -105,18 +124,95 @@ func NewMConnection(conn net.Conn, chDescs []*ChannelDescriptor, onReceive recei
 func (c *MConnection) Start() {
 	if atomic.CompareAndSwapUint32(&c.started, 0, 1) {
 		log.Debug("Starting %v", c)
+		if err := c.exchangeHandshake(); err != nil {
+			log.Info("%v failed handshake: %v", c, err)
+			c.stopForError(err)
+			return
+		}
 		go c.sendRoutine()
 		go c.recvRoutine()
 	}
 }
 
+// exchangeHandshake tells the peer which codec we'd like to use on each
+// channel and the largest packet payload we're willing to read, and learns
+// the peer's side of both in turn. A channel only ends up compressed if
+// both sides agree on the exact codec; otherwise it falls back to
+// CompressionNone so the connection still works with peers running an
+// older or differently configured build. maxPacketMsgPayloadSize is
+// clamped down to the smaller of the two sides, never negotiated upward,
+// so neither peer can be forced to allocate more than it asked for. The
+// whole exchange is bounded by handshakeTimeout, mirroring
+// MakeSecretConnection, so a peer that connects and never speaks can't
+// wedge Start() forever.
+func (c *MConnection) exchangeHandshake() error {
+	if err := c.conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	defer c.conn.SetDeadline(time.Time{})
+
+	var n int64
+	var err error
+	WriteByte(c.bufWriter, packetTypeHandshake, &n, &err)
+	WriteByte(c.bufWriter, byte(len(c.channels)), &n, &err)
+	for _, channel := range c.channels {
+		WriteByte(c.bufWriter, channel.id, &n, &err)
+		WriteByte(c.bufWriter, byte(channel.desc.Compression), &n, &err)
+	}
+	var sizeBuf [4]byte
+	stdbinary.BigEndian.PutUint32(sizeBuf[:], uint32(c.maxPacketMsgPayloadSize))
+	if err == nil {
+		wrote, werr := c.bufWriter.Write(sizeBuf[:])
+		n += int64(wrote)
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	if err = c.bufWriter.Flush(); err != nil {
+		return err
+	}
+
+	pktType := ReadByte(c.bufReader, &n, &err)
+	if err != nil {
+		return err
+	}
+	if pktType != packetTypeHandshake {
+		return fmt.Errorf("expected handshake packet, got %X", pktType)
+	}
+	numChannels := ReadByte(c.bufReader, &n, &err)
+	peerCompression := make(map[byte]Compression, numChannels)
+	for i := byte(0); i < numChannels; i++ {
+		chId := ReadByte(c.bufReader, &n, &err)
+		comp := ReadByte(c.bufReader, &n, &err)
+		peerCompression[chId] = Compression(comp)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(c.bufReader, sizeBuf[:]); err != nil {
+		return err
+	}
+	if peerMaxPayload := int(stdbinary.BigEndian.Uint32(sizeBuf[:])); peerMaxPayload < c.maxPacketMsgPayloadSize {
+		c.maxPacketMsgPayloadSize = peerMaxPayload
+	}
+
+	for _, channel := range c.channels {
+		if peerComp, ok := peerCompression[channel.id]; ok && peerComp == channel.desc.Compression {
+			channel.compression = channel.desc.Compression
+		} else {
+			channel.compression = CompressionNone
+		}
+	}
+	return nil
+}
+
 func (c *MConnection) Stop() {
 	if atomic.CompareAndSwapUint32(&c.stopped, 0, 1) {
 		log.Debug("Stopping %v", c)
 		close(c.quit)
 		c.conn.Close()
 		c.flushTimer.Stop()
-		c.chStatsTimer.Stop()
 		c.pingTimer.Stop()
 		// We can't close pong safely here because
 		// recvRoutine may write to it after we've stopped.
@@ -158,12 +254,22 @@ func (c *MConnection) stopForError(r interface{}) {
 }
 
 // Queues a message to be sent to channel.
+// Send gives up and returns false if the channel's send queue is still full
+// after defaultSendTimeout, so a wedged peer on one channel can't block the
+// reactor forever. Use SendWithTimeout to pick a different deadline.
 func (c *MConnection) Send(chId byte, msg Binary) bool {
+	return c.SendWithTimeout(chId, msg, defaultSendTimeout)
+}
+
+// Queues a message to be sent to channel, giving up after timeout if the
+// channel's send queue is full.
+// Returns true if successful.
+func (c *MConnection) SendWithTimeout(chId byte, msg Binary, timeout time.Duration) bool {
 	if atomic.LoadUint32(&c.stopped) == 1 {
 		return false
 	}
 
-	log.Debug("[%X][%v] Send: %v", chId, c, msg)
+	log.Debug("[%X][%v] SendWithTimeout: %v", chId, c, msg)
 
 	// Send message to channel.
 	channel, ok := c.channelsIdx[chId]
@@ -172,15 +278,16 @@ func (c *MConnection) Send(chId byte, msg Binary) bool {
 		return false
 	}
 
-	channel.sendBytes(BinaryBytes(msg))
-
-	// Wake up sendRoutine if necessary
-	select {
-	case c.send <- struct{}{}:
-	default:
+	ok = channel.sendBytesWithTimeout(BinaryBytes(msg), timeout)
+	if ok {
+		// Wake up sendRoutine if necessary
+		select {
+		case c.send <- struct{}{}:
+		default:
+		}
 	}
 
-	return true
+	return ok
 }
 
 // Queues a message to be sent to channel.
@@ -237,10 +344,6 @@ FOR_LOOP:
 			// NOTE: flushTimer.Set() must be called every time
 			// something is written to .bufWriter.
 			c.flush()
-		case <-c.chStatsTimer.Ch:
-			for _, channel := range c.channels {
-				channel.updateStats()
-			}
 		case <-c.pingTimer.Ch:
 			WriteByte(c.bufWriter, packetTypePing, &n, &err)
 			c.sendMonitor.Update(int(n))
@@ -253,12 +356,27 @@ FOR_LOOP:
 			break FOR_LOOP
 		case <-c.send:
 			// Send some packets
-			eof := c.sendSomePackets()
-			if !eof {
-				// Keep sendRoutine awake.
-				select {
-				case c.send <- struct{}{}:
-				default:
+			done, rateBlocked := c.sendSomePackets()
+			if !done {
+				if rateBlocked {
+					// Every pending channel is over its own SendRate
+					// budget. Retry after a short delay instead of
+					// immediately re-arming c.send and spinning this
+					// goroutine at 100% CPU until some window clears -
+					// and unlike blocking inline here, FOR_LOOP stays free
+					// to service quit/flush/ping/pong in the meantime.
+					time.AfterFunc(rateBlockedRetryInterval, func() {
+						select {
+						case c.send <- struct{}{}:
+						default:
+						}
+					})
+				} else {
+					// Keep sendRoutine awake.
+					select {
+					case c.send <- struct{}{}:
+					default:
+					}
 				}
 			}
 		}
@@ -276,59 +394,104 @@ FOR_LOOP:
 	// Cleanup
 }
 
-// Returns true if messages from channels were exhausted.
+// Returns done=true if messages from channels were exhausted, and
+// rateBlocked=true if it stopped early only because every channel with
+// something to send is over its own SendRate budget - see sendPacket.
 // Blocks in accordance to .sendMonitor throttling.
-func (c *MConnection) sendSomePackets() bool {
+func (c *MConnection) sendSomePackets() (done bool, rateBlocked bool) {
 	// Block until .sendMonitor says we can write.
 	// Once we're ready we send more than we asked for,
 	// but amortized it should even out.
-	c.sendMonitor.Limit(maxPacketSize, atomic.LoadInt64(&c.sendRate), true)
+	c.sendMonitor.Limit(c.maxPacketMsgPayloadSize+packetHeaderSize, atomic.LoadInt64(&c.sendRate), true)
 
 	// Now send some packets.
 	for i := 0; i < numBatchPackets; i++ {
-		if c.sendPacket() {
-			return true
+		done, rateBlocked = c.sendPacket()
+		if done || rateBlocked {
+			return done, rateBlocked
 		}
 	}
-	return false
-}
-
-// Returns true if messages from channels were exhausted.
-func (c *MConnection) sendPacket() bool {
-	// Choose a channel to create a packet from.
-	// The chosen channel will be the one whose recentlySent/priority is the least.
-	var leastRatio float32 = math.MaxFloat32
-	var leastChannel *Channel
+	return false, false
+}
+
+// deficitCap bounds how much deficit a single channel may carry into the
+// next round. Without a cap, a channel held back only by its own SendRate
+// keeps earning `priority` deficit every round it can't spend, and bursts
+// far past its fair share the moment its rate window opens; one packet's
+// worth of headroom is all a channel needs to never stall on the round its
+// window clears.
+func (c *MConnection) deficitCap(channel *Channel) int64 {
+	return int64(c.maxPacketMsgPayloadSize) + int64(channel.priority)
+}
+
+// sendPacket services at most one channel's pending packet using a
+// weighted deficit round-robin: every channel with something to send earns
+// `priority` deficit each round, and only a channel whose deficit has grown
+// to cover a full packet gets to dequeue one. This replaces the old
+// least-recently-sent heuristic, which let a high-priority channel get
+// starved for exactly one round and then dominate again. A channel with
+// its own SendRate is additionally held back by its per-channel
+// flow.Monitor, independent of the connection-wide cap.
+//
+// done is true once no channel has anything left to send. rateBlocked is
+// true if nothing was sent this round only because every channel with
+// enough deficit to send is over its own SendRate budget - the caller
+// should back off briefly rather than immediately retrying.
+func (c *MConnection) sendPacket() (done bool, rateBlocked bool) {
+	pending := false
 	for _, channel := range c.channels {
-		// If nothing to send, skip this channel
 		if !channel.isSendPending() {
 			continue
 		}
-		// Get ratio, and keep track of lowest ratio.
-		ratio := float32(channel.recentlySent) / float32(channel.priority)
-		if ratio < leastRatio {
-			leastRatio = ratio
-			leastChannel = channel
+		pending = true
+		channel.deficit += int64(channel.priority)
+		if cap := c.deficitCap(channel); channel.deficit > cap {
+			channel.deficit = cap
 		}
 	}
-
-	// Nothing to send?
-	if leastChannel == nil {
-		return true
-	} else {
-		// log.Debug("Found a packet to send")
+	if !pending {
+		return true, false
 	}
 
-	// Make & send a packet from this channel
-	n, err := leastChannel.writePacketTo(c.bufWriter)
-	if err != nil {
-		log.Warning("Failed to write packet. Error: %v", err)
-		c.stopForError(err)
-		return true
+	deficitShort := false
+	for _, channel := range c.channels {
+		if !channel.isSendPending() {
+			continue
+		}
+		packetSize := int64(MinInt(c.maxPacketMsgPayloadSize, len(channel.sending)))
+		if channel.deficit < packetSize {
+			deficitShort = true
+			continue
+		}
+		if channel.sendMonitor != nil {
+			if allowed := channel.sendMonitor.Limit(int(packetSize), channel.sendRate, false); allowed < int(packetSize) {
+				// Over its per-channel rate budget this round; let other
+				// channels have a turn instead of blocking on this one.
+				rateBlocked = true
+				continue
+			}
+		}
+
+		n, err := channel.writePacketTo(c.bufWriter)
+		if err != nil {
+			log.Warning("Failed to write packet. Error: %v", err)
+			c.stopForError(err)
+			return true, false
+		}
+		channel.deficit -= packetSize
+		c.sendMonitor.Update(int(n))
+		if channel.sendMonitor != nil {
+			channel.sendMonitor.Update(int(n))
+		}
+		c.flushTimer.Set()
+		return false, false
 	}
-	c.sendMonitor.Update(int(n))
-	c.flushTimer.Set()
-	return false
+
+	// Every pending channel is either short on deficit or over its rate
+	// budget this round; nothing sent, but messages remain queued. A channel
+	// short on deficit will be able to send after more rounds, so only
+	// report rateBlocked when none is.
+	return false, rateBlocked && !deficitShort
 }
 
 // recvRoutine reads packets and reconstructs the message using the channels' "recving" buffer.
@@ -340,7 +503,7 @@ func (c *MConnection) recvRoutine() {
 FOR_LOOP:
 	for {
 		// Block until .recvMonitor says we can read.
-		c.recvMonitor.Limit(maxPacketSize, atomic.LoadInt64(&c.recvRate), true)
+		c.recvMonitor.Limit(c.maxPacketMsgPayloadSize+packetHeaderSize, atomic.LoadInt64(&c.recvRate), true)
 
 		// Read packet type
 		var n int64
@@ -372,7 +535,7 @@ FOR_LOOP:
 		case packetTypePong:
 			// do nothing
 		case packetTypeMessage:
-			pkt, n, err := readPacketSafe(c.bufReader)
+			pkt, n, err := readPacketSafe(c.bufReader, c.maxPacketMsgPayloadSize)
 			c.recvMonitor.Update(int(n))
 			if err != nil {
 				if atomic.LoadUint32(&c.stopped) != 1 {
@@ -407,9 +570,44 @@ FOR_LOOP:
 
 //-----------------------------------------------------------------------------
 
+// Compression identifies the codec used to compress whole messages on a
+// channel before they're chopped into packets.
+type Compression byte
+
+const (
+	CompressionNone   = Compression(0x00)
+	CompressionSnappy = Compression(0x01)
+	CompressionZstd   = Compression(0x02)
+)
+
 type ChannelDescriptor struct {
 	Id       byte
 	Priority uint
+
+	SendQueueCapacity   int
+	RecvBufferCapacity  int
+	RecvMessageCapacity int
+	Compression         Compression
+
+	// SendRate, if positive, caps this channel's own send rate (bytes/sec)
+	// independent of the connection-wide send rate. Leave zero to only be
+	// bound by the connection-wide cap.
+	SendRate int64
+}
+
+// FillDefaults fills in any zero-valued capacity fields with sane defaults.
+// NewMConnection calls it on every descriptor it's given; calling it again
+// is harmless.
+func (chDesc *ChannelDescriptor) FillDefaults() {
+	if chDesc.SendQueueCapacity == 0 {
+		chDesc.SendQueueCapacity = defaultSendQueueCapacity
+	}
+	if chDesc.RecvBufferCapacity == 0 {
+		chDesc.RecvBufferCapacity = defaultRecvBufferCapacity
+	}
+	if chDesc.RecvMessageCapacity == 0 {
+		chDesc.RecvMessageCapacity = defaultRecvMessageCapacity
+	}
 }
 
 // TODO: lowercase.
@@ -423,28 +621,53 @@ type Channel struct {
 	recving       []byte
 	sending       []byte
 	priority      uint
-	recentlySent  int64 // exponential moving average
+
+	// compression is the codec actually negotiated with the peer for this
+	// channel; it may fall back to CompressionNone even if desc.Compression
+	// asks for something else, if the peer doesn't advertise the same codec.
+	compression Compression
+
+	// deficit round-robin scheduling state, see MConnection.sendPacket.
+	deficit int64
+
+	// sendMonitor enforces desc.SendRate for this channel alone; nil if
+	// desc.SendRate is unset, in which case only the connection-wide
+	// sendMonitor applies.
+	sendMonitor *flow.Monitor
+	sendRate    int64
 }
 
 func newChannel(conn *MConnection, desc *ChannelDescriptor) *Channel {
 	if desc.Priority <= 0 {
 		panic("Channel default priority must be a postive integer")
 	}
-	return &Channel{
+	channel := &Channel{
 		conn:      conn,
 		desc:      desc,
 		id:        desc.Id,
-		sendQueue: make(chan []byte, defaultSendQueueCapacity),
-		recving:   make([]byte, 0, defaultRecvBufferCapacity),
+		sendQueue: make(chan []byte, desc.SendQueueCapacity),
+		recving:   make([]byte, 0, desc.RecvBufferCapacity),
 		priority:  desc.Priority,
+		sendRate:  desc.SendRate,
+	}
+	if desc.SendRate > 0 {
+		channel.sendMonitor = flow.New(0, 0)
 	}
+	return channel
 }
 
 // Queues message to send to this channel.
+// Blocks until the send succeeds or timeout elapses.
+// Returns true if successful.
 // Goroutine-safe
-func (ch *Channel) sendBytes(bytes []byte) {
-	ch.sendQueue <- bytes
-	atomic.AddUint32(&ch.sendQueueSize, 1)
+func (ch *Channel) sendBytesWithTimeout(bytes []byte, timeout time.Duration) bool {
+	select {
+	case ch.sendQueue <- bytes:
+		atomic.AddUint32(&ch.sendQueueSize, 1)
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 // Queues message to send to this channel.
@@ -468,7 +691,7 @@ func (ch *Channel) loadSendQueueSize() (size int) {
 // Goroutine-safe
 // Use only as a heuristic.
 func (ch *Channel) canSend() bool {
-	return ch.loadSendQueueSize() < defaultSendQueueCapacity
+	return ch.loadSendQueueSize() < ch.desc.SendQueueCapacity
 }
 
 // Returns true if any packets are pending to be sent.
@@ -479,7 +702,9 @@ func (ch *Channel) isSendPending() bool {
 		if len(ch.sendQueue) == 0 {
 			return false
 		}
-		ch.sending = <-ch.sendQueue
+		// Compress the whole message once, up front, so the packets it's
+		// chopped into on the wire are already the compressed bytes.
+		ch.sending = ch.compressBytes(<-ch.sendQueue)
 	}
 	return true
 }
@@ -487,72 +712,180 @@ func (ch *Channel) isSendPending() bool {
 // Creates a new packet to send.
 // Not goroutine-safe
 func (ch *Channel) nextPacket() packet {
+	maxPayloadSize := ch.conn.maxPacketMsgPayloadSize
 	packet := packet{}
 	packet.ChannelId = byte(ch.id)
-	packet.Bytes = ch.sending[:MinInt(maxPacketSize, len(ch.sending))]
-	if len(ch.sending) <= maxPacketSize {
+	packet.Compression = byte(ch.compression)
+	packet.Bytes = ch.sending[:MinInt(maxPayloadSize, len(ch.sending))]
+	if len(ch.sending) <= maxPayloadSize {
 		packet.EOF = byte(0x01)
 		ch.sending = nil
 		atomic.AddUint32(&ch.sendQueueSize, ^uint32(0)) // decrement sendQueueSize
 	} else {
 		packet.EOF = byte(0x00)
-		ch.sending = ch.sending[MinInt(maxPacketSize, len(ch.sending)):]
+		ch.sending = ch.sending[MinInt(maxPayloadSize, len(ch.sending)):]
 	}
 	return packet
 }
 
+// compressBytes compresses raw with the channel's negotiated codec. If
+// compression fails for any reason, the original bytes are sent as-is
+// rather than dropping the message.
+func (ch *Channel) compressBytes(raw []byte) []byte {
+	switch ch.compression {
+	case CompressionSnappy:
+		out, err := snappy.Encode(nil, raw)
+		if err != nil {
+			return raw
+		}
+		return out
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return raw
+		}
+		defer enc.Close()
+		return enc.EncodeAll(raw, nil)
+	default:
+		return raw
+	}
+}
+
+// decompressBytes reverses compressBytes using the codec the sender
+// advertised on the packets that made up this message. The decompressed
+// size is bounded by RecvMessageCapacity before (snappy) or while (zstd)
+// the expansion happens, so a peer can't use a small compressed payload to
+// force an unbounded allocation - the same decompression-bomb concern
+// RecvMessageCapacity was added for in the first place.
+func (ch *Channel) decompressBytes(data []byte, c Compression) ([]byte, error) {
+	limit := ch.desc.RecvMessageCapacity
+	switch c {
+	case CompressionSnappy:
+		decodedLen, err := snappyDecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if decodedLen > limit {
+			return nil, fmt.Errorf("decompressed snappy payload (%v bytes) exceeds RecvMessageCapacity (%v)", decodedLen, limit)
+		}
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		// Read one byte past limit so an exact-limit stream isn't
+		// mistaken for a truncated, over-limit one.
+		out, err := io.ReadAll(io.LimitReader(dec, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, fmt.Errorf("decompressed zstd payload exceeds RecvMessageCapacity (%v)", limit)
+		}
+		return out, nil
+	default:
+		return data, nil
+	}
+}
+
+// snappyDecodedLen reads the uncompressed length a snappy block declares in
+// its header, without decompressing it, so callers can reject an
+// oversized-but-still-small-on-the-wire payload before allocating for it.
+func snappyDecodedLen(src []byte) (int, error) {
+	decodedLen, n := stdbinary.Uvarint(src)
+	if n <= 0 {
+		return 0, errors.New("invalid snappy block header")
+	}
+	return int(decodedLen), nil
+}
+
 // Writes next packet to w.
 // Not goroutine-safe
 func (ch *Channel) writePacketTo(w io.Writer) (n int64, err error) {
 	packet := ch.nextPacket()
 	WriteByte(w, packetTypeMessage, &n, &err)
 	WriteBinary(w, packet, &n, &err)
-	if err != nil {
-		ch.recentlySent += n
-	}
 	return
 }
 
 // Handles incoming packets. Returns a msg bytes if msg is complete.
 // Not goroutine-safe
 func (ch *Channel) recvPacket(pkt packet) []byte {
+	if want, got := len(ch.recving)+len(pkt.Bytes), ch.desc.RecvMessageCapacity; want > got {
+		// readPacketSafe only bounds each packet's payload; this is where
+		// the size of the whole message being assembled is bounded.
+		ch.conn.stopForError(fmt.Errorf("received message exceeds available capacity: %v > %v", want, got))
+		return nil
+	}
+	// The sender doesn't get to pick our codec: only trust what was
+	// negotiated in the handshake, never the per-packet Compression byte.
+	// Otherwise a peer could force us to spend cycles running an arbitrary
+	// decompressor on a channel we believed carried CompressionNone.
+	if Compression(pkt.Compression) != ch.compression {
+		ch.conn.stopForError(fmt.Errorf("channel %X received packet advertising compression %X, but negotiated %X", ch.id, pkt.Compression, ch.compression))
+		return nil
+	}
 	ch.recving = append(ch.recving, pkt.Bytes...)
 	if pkt.EOF == byte(0x01) {
-		msgBytes := ch.recving
-		ch.recving = make([]byte, 0, defaultRecvBufferCapacity)
+		msgBytes, err := ch.decompressBytes(ch.recving, ch.compression)
+		ch.recving = make([]byte, 0, ch.desc.RecvBufferCapacity)
+		if err != nil {
+			ch.conn.stopForError(fmt.Errorf("failed to decompress message on channel %X: %v", ch.id, err))
+			return nil
+		}
 		return msgBytes
 	}
 	return nil
 }
 
-// Call this periodically to update stats for throttling purposes.
-// Not goroutine-safe
-func (ch *Channel) updateStats() {
-	// Exponential decay of stats.
-	// TODO: optimize.
-	ch.recentlySent = int64(float64(ch.recentlySent) * 0.5)
-}
-
 //-----------------------------------------------------------------------------
 
 const (
-	maxPacketSize     = 1024
-	packetTypePing    = byte(0x00)
-	packetTypePong    = byte(0x01)
-	packetTypeMessage = byte(0x10)
+	// defaultMaxPacketMsgPayloadSize is our initial offer in the connection
+	// handshake; the effective cap (MConnection.maxPacketMsgPayloadSize) is
+	// whichever side asks for less, see exchangeHandshake.
+	defaultMaxPacketMsgPayloadSize = 1024
+
+	// packetHeaderSize is the fixed-size portion of a packet on the wire:
+	// the packetTypeMessage byte writePacketTo prepends, then ChannelId +
+	// EOF + Compression + a 4-byte payload length prefix.
+	packetHeaderSize = 1 + 1 + 1 + 1 + 4
+
+	packetTypePing      = byte(0x00)
+	packetTypePong      = byte(0x01)
+	packetTypeHandshake = byte(0x02)
+	packetTypeMessage   = byte(0x10)
 )
 
 // Messages in channels are chopped into smaller packets for multiplexing.
+// Bytes is capped at the connection's negotiated maxPacketMsgPayloadSize.
 type packet struct {
-	ChannelId byte
-	EOF       byte // 1 means message ends here.
-	Bytes     []byte
+	ChannelId   byte
+	EOF         byte // 1 means message ends here.
+	Compression byte // codec the sender used on Bytes, see Compression
+	Bytes       []byte
 }
 
 func (p packet) WriteTo(w io.Writer) (n int64, err error) {
 	WriteByte(w, p.ChannelId, &n, &err)
 	WriteByte(w, p.EOF, &n, &err)
-	WriteByteSlice(w, p.Bytes, &n, &err)
+	WriteByte(w, p.Compression, &n, &err)
+	if err != nil {
+		return
+	}
+	var lenBuf [4]byte
+	stdbinary.BigEndian.PutUint32(lenBuf[:], uint32(len(p.Bytes)))
+	wrote, werr := w.Write(lenBuf[:])
+	n += int64(wrote)
+	if werr != nil {
+		err = werr
+		return
+	}
+	wrote, werr = w.Write(p.Bytes)
+	n += int64(wrote)
+	err = werr
 	return
 }
 
@@ -560,11 +893,38 @@ func (p packet) String() string {
 	return fmt.Sprintf("Packet{%X:%X}", p.ChannelId, p.Bytes)
 }
 
-func readPacketSafe(r io.Reader) (pkt packet, n int64, err error) {
+// readPacketSafe reads a packet off r, rejecting any packet whose declared
+// payload length exceeds maxPacketMsgPayloadSize before allocating a buffer
+// for it. Without this check a peer could send a length prefix far larger
+// than it ever intends to follow through on and force us to allocate
+// unboundedly ahead of noticing the connection is bad.
+func readPacketSafe(r io.Reader, maxPacketMsgPayloadSize int) (pkt packet, n int64, err error) {
 	chId := ReadByte(r, &n, &err)
 	eof := ReadByte(r, &n, &err)
-	bytes := ReadByteSlice(r, &n, &err)
-	pkt = packet{chId, eof, bytes}
+	compression := ReadByte(r, &n, &err)
+	if err != nil {
+		return
+	}
+
+	var lenBuf [4]byte
+	read, err := io.ReadFull(r, lenBuf[:])
+	n += int64(read)
+	if err != nil {
+		return
+	}
+	payloadSize := stdbinary.BigEndian.Uint32(lenBuf[:])
+	if int(payloadSize) > maxPacketMsgPayloadSize {
+		err = fmt.Errorf("packet payload size %v exceeds maxPacketMsgPayloadSize %v", payloadSize, maxPacketMsgPayloadSize)
+		return
+	}
+
+	msgBytes := make([]byte, payloadSize)
+	read, err = io.ReadFull(r, msgBytes)
+	n += int64(read)
+	if err != nil {
+		return
+	}
+	pkt = packet{chId, eof, compression, msgBytes}
 	return
 }
 
@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"bytes"
+	stdbinary "encoding/binary"
+	"testing"
+)
+
+// TestReadPacketSafeRejectsOversizedPayload verifies that readPacketSafe
+// rejects a declared payload length greater than maxPacketMsgPayloadSize
+// before it allocates a buffer for it, rather than trusting the peer and
+// blocking on (or allocating for) a payload that never arrives.
+func TestReadPacketSafeRejectsOversizedPayload(t *testing.T) {
+	const maxPacketMsgPayloadSize = 16
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x01) // ChannelId
+	buf.WriteByte(0x01) // EOF
+	buf.WriteByte(byte(CompressionNone))
+	var lenBuf [4]byte
+	stdbinary.BigEndian.PutUint32(lenBuf[:], maxPacketMsgPayloadSize+1)
+	buf.Write(lenBuf[:])
+	buf.Write(make([]byte, maxPacketMsgPayloadSize+1))
+
+	_, _, err := readPacketSafe(&buf, maxPacketMsgPayloadSize)
+	if err == nil {
+		t.Fatal("expected readPacketSafe to reject a payload larger than maxPacketMsgPayloadSize, got nil error")
+	}
+}
+
+// TestReadPacketSafeAcceptsPayloadAtLimit verifies the boundary case: a
+// payload exactly at maxPacketMsgPayloadSize must still be accepted.
+func TestReadPacketSafeAcceptsPayloadAtLimit(t *testing.T) {
+	const maxPacketMsgPayloadSize = 16
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x01)
+	buf.WriteByte(0x01)
+	buf.WriteByte(byte(CompressionNone))
+	var lenBuf [4]byte
+	stdbinary.BigEndian.PutUint32(lenBuf[:], maxPacketMsgPayloadSize)
+	buf.Write(lenBuf[:])
+	payload := bytes.Repeat([]byte{0xAB}, maxPacketMsgPayloadSize)
+	buf.Write(payload)
+
+	pkt, _, err := readPacketSafe(&buf, maxPacketMsgPayloadSize)
+	if err != nil {
+		t.Fatalf("expected a payload at exactly maxPacketMsgPayloadSize to be accepted, got error: %v", err)
+	}
+	if !bytes.Equal(pkt.Bytes, payload) {
+		t.Fatalf("payload mismatch: got %X, want %X", pkt.Bytes, payload)
+	}
+}
@@ -0,0 +1,311 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// dataMaxSize is the largest plaintext chunk carried by a single encrypted
+// frame. Writes larger than this are split across multiple frames; reads
+// transparently reassemble them.
+const dataMaxSize = 1024
+
+// dataLenSize is the width of the cleartext length prefix written ahead of
+// each frame's nonce and ciphertext, so Read knows how many ciphertext
+// bytes to pull off the wire without every frame being padded out to
+// dataMaxSize. The length isn't secret - it's already visible from
+// ciphertext sizes on the wire - but it is authenticated as AEAD
+// associated data, so tampering with it is caught by Open rather than
+// silently desyncing the stream.
+const dataLenSize = 4
+
+// aeadNonceSize is the width of a ChaCha20-Poly1305 nonce: 96 bits, filled
+// in from a per-direction counter that increments once per frame.
+const aeadNonceSize = chacha20poly1305.NonceSize
+
+// handshakeTimeout bounds how long MakeSecretConnection will block
+// performing the handshake, so a peer that stalls mid-handshake can't tie
+// up a goroutine - or, behind a listener, an accept slot - indefinitely.
+const handshakeTimeout = 20 * time.Second
+
+// SecretConnection wraps a net.Conn with an authenticated Diffie-Hellman
+// handshake (X25519) and a ChaCha20-Poly1305 AEAD stream, so that peers are
+// identified by a long-term Ed25519 key and traffic can't be read or
+// tampered with on the wire. Construct one with MakeSecretConnection; it
+// satisfies net.Conn so it can be handed straight to NewMConnection.
+type SecretConnection struct {
+	conn net.Conn
+
+	recvAead cipher.AEAD
+	sendAead cipher.AEAD
+
+	recvNonce uint64
+	sendNonce uint64
+
+	recvBuffer []byte
+
+	remotePubKey ed25519.PublicKey
+}
+
+// RemotePubKey returns the peer's long-term signing key, as authenticated
+// by the handshake in MakeSecretConnection.
+func (sc *SecretConnection) RemotePubKey() ed25519.PublicKey {
+	return sc.remotePubKey
+}
+
+func (sc *SecretConnection) LocalAddr() net.Addr  { return sc.conn.LocalAddr() }
+func (sc *SecretConnection) RemoteAddr() net.Addr { return sc.conn.RemoteAddr() }
+func (sc *SecretConnection) Close() error         { return sc.conn.Close() }
+
+func (sc *SecretConnection) SetDeadline(t time.Time) error      { return sc.conn.SetDeadline(t) }
+func (sc *SecretConnection) SetReadDeadline(t time.Time) error  { return sc.conn.SetReadDeadline(t) }
+func (sc *SecretConnection) SetWriteDeadline(t time.Time) error { return sc.conn.SetWriteDeadline(t) }
+
+// Write encrypts data and writes it to the underlying conn in dataMaxSize
+// chunks, each as its own AEAD frame. Unlike a fixed-size frame, a short
+// chunk is sealed and written at its own length, not padded out to
+// dataMaxSize - important once chunk0-2's per-channel compression is in
+// play, since most compressed messages land well under that ceiling.
+func (sc *SecretConnection) Write(data []byte) (n int, err error) {
+	for len(data) > 0 {
+		var chunk []byte
+		if len(data) > dataMaxSize {
+			chunk, data = data[:dataMaxSize], data[dataMaxSize:]
+		} else {
+			chunk, data = data, nil
+		}
+
+		lenBytes := make([]byte, dataLenSize)
+		binary.BigEndian.PutUint32(lenBytes, uint32(len(chunk)))
+
+		nonce := make([]byte, aeadNonceSize)
+		binary.BigEndian.PutUint64(nonce[aeadNonceSize-8:], sc.sendNonce)
+		sc.sendNonce++
+
+		sealed := sc.sendAead.Seal(nil, nonce, chunk, lenBytes)
+		if _, werr := sc.conn.Write(lenBytes); werr != nil {
+			return n, werr
+		}
+		if _, werr := sc.conn.Write(nonce); werr != nil {
+			return n, werr
+		}
+		if _, werr := sc.conn.Write(sealed); werr != nil {
+			return n, werr
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// Read decrypts the next frame off the underlying conn into data. Anything
+// that doesn't fit in data is buffered and returned by later calls before
+// another frame is read.
+func (sc *SecretConnection) Read(data []byte) (n int, err error) {
+	if len(sc.recvBuffer) > 0 {
+		n = copy(data, sc.recvBuffer)
+		sc.recvBuffer = sc.recvBuffer[n:]
+		return n, nil
+	}
+
+	lenBytes := make([]byte, dataLenSize)
+	if _, err = io.ReadFull(sc.conn, lenBytes); err != nil {
+		return 0, err
+	}
+	chunkLen := binary.BigEndian.Uint32(lenBytes)
+	if chunkLen > dataMaxSize {
+		return 0, errors.New("SecretConnection: chunk length exceeds dataMaxSize")
+	}
+
+	nonce := make([]byte, aeadNonceSize)
+	if _, err = io.ReadFull(sc.conn, nonce); err != nil {
+		return 0, err
+	}
+	binary.BigEndian.PutUint64(nonce[aeadNonceSize-8:], sc.recvNonce)
+
+	sealed := make([]byte, int(chunkLen)+sc.recvAead.Overhead())
+	if _, err = io.ReadFull(sc.conn, sealed); err != nil {
+		return 0, err
+	}
+	chunk, err := sc.recvAead.Open(nil, nonce, sealed, lenBytes)
+	if err != nil {
+		return 0, fmt.Errorf("SecretConnection: failed to decrypt frame: %v", err)
+	}
+	sc.recvNonce++
+
+	n = copy(data, chunk)
+	sc.recvBuffer = chunk[n:]
+	return n, nil
+}
+
+// MakeSecretConnection performs an authenticated Diffie-Hellman handshake
+// over conn and returns a SecretConnection that encrypts and authenticates
+// everything read and written from then on.
+//
+// Each side generates an ephemeral X25519 key and exchanges public keys in
+// the clear, then derives a shared secret. The two ephemeral pubkeys are
+// ordered lexicographically (the "lo" and "hi" keys) so both sides derive
+// identical send/recv subkeys and a shared challenge value without needing
+// to agree in advance who's the dialer. Each side signs the challenge with
+// its long-term Ed25519 key, and the two sides exchange (pubkey,
+// signature) pairs - now under the freshly-established AEAD - and reject
+// the peer if its signature over the challenge doesn't verify under the
+// pubkey it just presented.
+func MakeSecretConnection(conn net.Conn, locPrivKey ed25519.PrivateKey) (*SecretConnection, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	locEphPub, locEphPriv, err := genEphKeypair()
+	if err != nil {
+		return nil, err
+	}
+
+	remEphPub, err := shareEphPubKey(conn, locEphPub)
+	if err != nil {
+		return nil, err
+	}
+
+	var sharedSecret [32]byte
+	curve25519.ScalarMult(&sharedSecret, locEphPriv, remEphPub)
+
+	loEphPub, hiEphPub, locIsLo := loHi(locEphPub, remEphPub)
+	sendSecret, recvSecret, challenge := deriveSecrets(sharedSecret[:], loEphPub[:], hiEphPub[:])
+	if !locIsLo {
+		sendSecret, recvSecret = recvSecret, sendSecret
+	}
+
+	sendAead, err := chacha20poly1305.New(sendSecret)
+	if err != nil {
+		return nil, err
+	}
+	recvAead, err := chacha20poly1305.New(recvSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SecretConnection{
+		conn:     conn,
+		sendAead: sendAead,
+		recvAead: recvAead,
+	}
+
+	locSignature := ed25519.Sign(locPrivKey, challenge)
+	locPubKey := locPrivKey.Public().(ed25519.PublicKey)
+	remPubKey, remSignature, err := shareAuth(sc, locPubKey, locSignature)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(remPubKey, challenge, remSignature) {
+		return nil, errors.New("SecretConnection: challenge signature verification failed")
+	}
+	sc.remotePubKey = remPubKey
+
+	return sc, nil
+}
+
+// genEphKeypair generates an ephemeral X25519 keypair for one handshake.
+func genEphKeypair() (pub, priv *[32]byte, err error) {
+	priv = new([32]byte)
+	if _, err = io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return nil, nil, err
+	}
+	pub = new([32]byte)
+	curve25519.ScalarBaseMult(pub, priv)
+	return pub, priv, nil
+}
+
+// shareEphPubKey exchanges ephemeral pubkeys with the peer over the raw
+// conn. Both sides write before either reads, so a synchronous
+// write-then-read on both ends would deadlock; the write happens on a
+// goroutine instead.
+func shareEphPubKey(conn net.Conn, locEphPub *[32]byte) (*[32]byte, error) {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(locEphPub[:])
+		writeErr <- err
+	}()
+
+	remEphPub := new([32]byte)
+	_, readErr := io.ReadFull(conn, remEphPub[:])
+	if werr := <-writeErr; werr != nil {
+		return nil, werr
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return remEphPub, nil
+}
+
+// shareAuth exchanges (pubkey, signature) pairs over the now-encrypted sc,
+// with the same write-before-read concurrency concern as shareEphPubKey.
+func shareAuth(sc *SecretConnection, locPubKey ed25519.PublicKey, locSignature []byte) (ed25519.PublicKey, []byte, error) {
+	msg := make([]byte, len(locPubKey)+len(locSignature))
+	copy(msg, locPubKey)
+	copy(msg[len(locPubKey):], locSignature)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := sc.Write(msg)
+		writeErr <- err
+	}()
+
+	remMsg := make([]byte, len(locPubKey)+len(locSignature))
+	_, readErr := io.ReadFull(sc, remMsg)
+	if werr := <-writeErr; werr != nil {
+		return nil, nil, werr
+	}
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+
+	remPubKey := ed25519.PublicKey(remMsg[:len(locPubKey)])
+	remSignature := remMsg[len(locPubKey):]
+	return remPubKey, remSignature, nil
+}
+
+// loHi orders two ephemeral pubkeys deterministically so both ends of a
+// handshake agree on which is "lo" and which is "hi" without needing to
+// know who dialed. It also reports whether the local key is the lo one.
+func loHi(locEphPub, remEphPub *[32]byte) (lo, hi *[32]byte, locIsLo bool) {
+	if bytes.Compare(locEphPub[:], remEphPub[:]) < 0 {
+		return locEphPub, remEphPub, true
+	}
+	return remEphPub, locEphPub, false
+}
+
+// deriveSecrets turns the shared X25519 secret and the two (ordered)
+// ephemeral pubkeys into the lo-side's send key, the lo-side's recv key,
+// and the challenge both sides will sign. hi's send/recv are simply lo's
+// recv/send, swapped by the caller.
+func deriveSecrets(sharedSecret, loEphPub, hiEphPub []byte) (loSendSecret, loRecvSecret, challenge []byte) {
+	loSendSecret = hashOf(sharedSecret, loEphPub, hiEphPub, "SECRET_CONNECTION_LO_TO_HI")
+	loRecvSecret = hashOf(sharedSecret, loEphPub, hiEphPub, "SECRET_CONNECTION_HI_TO_LO")
+	challenge = hashOf(sharedSecret, loEphPub, hiEphPub, "SECRET_CONNECTION_CHALLENGE")
+	return
+}
+
+func hashOf(parts ...interface{}) []byte {
+	h := sha256.New()
+	for _, part := range parts {
+		switch v := part.(type) {
+		case []byte:
+			h.Write(v)
+		case string:
+			h.Write([]byte(v))
+		}
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"net"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// A Transport knows how to turn a freshly dialed or accepted net.Conn into
+// the connection MConnection should actually read and write. This is the
+// seam between "how do we get bytes to a peer" and "how do we multiplex
+// messages over those bytes" - it lets a plaintext TCP transport and an
+// authenticated/encrypted one (see SecretConnection) sit behind the same
+// interface, so NewMConnection never needs to know which one produced its
+// net.Conn.
+type Transport interface {
+	// Dial connects to addr ("host:port") and upgrades the resulting
+	// net.Conn, e.g. by performing a SecretConnection handshake.
+	Dial(addr string) (net.Conn, error)
+
+	// Upgrade prepares a net.Conn freshly accepted from a net.Listener for
+	// use by MConnection.
+	Upgrade(conn net.Conn) (net.Conn, error)
+}
+
+// TCPTransport is the default Transport: it hands back the raw TCP
+// connection unmodified. Peers connected this way are not authenticated and
+// their traffic is not encrypted.
+type TCPTransport struct{}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{}
+}
+
+func (t *TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (t *TCPTransport) Upgrade(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+// SecretTransport upgrades every connection to a SecretConnection, so peers
+// are authenticated by their long-term signing key and all traffic is
+// encrypted. See MakeSecretConnection.
+type SecretTransport struct {
+	privKey ed25519.PrivateKey
+}
+
+func NewSecretTransport(privKey ed25519.PrivateKey) *SecretTransport {
+	return &SecretTransport{privKey: privKey}
+}
+
+func (t *SecretTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return MakeSecretConnection(conn, t.privKey)
+}
+
+func (t *SecretTransport) Upgrade(conn net.Conn) (net.Conn, error) {
+	return MakeSecretConnection(conn, t.privKey)
+}